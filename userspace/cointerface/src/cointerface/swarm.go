@@ -2,17 +2,17 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"sort"
+	"sync"
 
 	"draiosproto"
 	"sdc_internal"
 	log "github.com/cihub/seelog"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/swarm"
-	"github.com/docker/docker/client"
 	"github.com/gogo/protobuf/proto"
-	"os"
 	"strings"
 )
 
@@ -39,39 +39,235 @@ func portsToProtobuf(ports []swarm.PortConfig) (ret []*draiosproto.SwarmPort) {
 	return
 }
 
+func networkAttachmentsToProtobuf(networks []swarm.NetworkAttachmentConfig) (ret []string) {
+	for _, network := range networks {
+		ret = append(ret, network.Target)
+	}
+	return
+}
+
+func secretRefsToProtobuf(secrets []*swarm.SecretReference) (ret []string) {
+	for _, secret := range secrets {
+		ret = append(ret, secret.SecretID)
+	}
+	return
+}
+
+func configRefsToProtobuf(configs []*swarm.ConfigReference) (ret []string) {
+	for _, config := range configs {
+		ret = append(ret, config.ConfigID)
+	}
+	return
+}
+
 func serviceToProtobuf(service swarm.Service) *draiosproto.SwarmService {
+	var networkIds, secretIds, configIds []string
+	networkIds = networkAttachmentsToProtobuf(service.Spec.TaskTemplate.Networks)
+	if container := service.Spec.TaskTemplate.ContainerSpec; container != nil {
+		secretIds = secretRefsToProtobuf(container.Secrets)
+		configIds = configRefsToProtobuf(container.Configs)
+	}
 	return &draiosproto.SwarmService{Common: &draiosproto.SwarmCommon{
 			Id:     proto.String(service.ID),
 			Name:   proto.String(service.Spec.Name),
 			Labels: labelsToProtobuf(service.Spec.Labels)},
 		VirtualIps: virtualIPsToProtobuf(service.Endpoint.VirtualIPs),
 		Ports:      portsToProtobuf(service.Endpoint.Ports),
+		NetworkIds: networkIds,
+		SecretIds:  secretIds,
+		ConfigIds:  configIds,
+	}
+}
+
+func networkToProtobuf(network types.NetworkResource) *draiosproto.SwarmNetwork {
+	return &draiosproto.SwarmNetwork{Common: &draiosproto.SwarmCommon{
+		Id:     proto.String(network.ID),
+		Name:   proto.String(network.Name),
+		Labels: labelsToProtobuf(network.Labels)},
+		Driver: proto.String(network.Driver),
+		Scope:  proto.String(network.Scope),
+	}
+}
+
+func secretToProtobuf(secret swarm.Secret) *draiosproto.SwarmSecret {
+	return &draiosproto.SwarmSecret{Common: &draiosproto.SwarmCommon{
+		Id:     proto.String(secret.ID),
+		Name:   proto.String(secret.Spec.Name),
+		Labels: labelsToProtobuf(secret.Spec.Labels)},
+	}
+}
+
+func configToProtobuf(config swarm.Config) *draiosproto.SwarmConfig {
+	return &draiosproto.SwarmConfig{Common: &draiosproto.SwarmCommon{
+		Id:     proto.String(config.ID),
+		Name:   proto.String(config.Spec.Name),
+		Labels: labelsToProtobuf(config.Spec.Labels)},
+	}
+}
+
+// taskSlot identifies one replica slot of a service: docker keeps the
+// shutdown/failed task objects for a slot around (rather than deleting
+// them) when it replaces them, so that slice is also our restart
+// history for the slot.
+type taskSlot struct {
+	serviceID string
+	slot      int
+}
+
+// taskSlotHistory groups tasks by service+slot and orders each group
+// newest-first by version, so taskToProtobuf can derive a restart
+// count and a link to the task it replaced.
+func taskSlotHistory(tasks []swarm.Task) map[taskSlot][]swarm.Task {
+	slots := make(map[taskSlot][]swarm.Task)
+	for _, task := range tasks {
+		key := taskSlot{serviceID: task.ServiceID, slot: task.Slot}
+		slots[key] = append(slots[key], task)
+	}
+	for _, siblings := range slots {
+		sort.Slice(siblings, func(i, j int) bool {
+			return siblings[i].Meta.Version.Index > siblings[j].Meta.Version.Index
+		})
 	}
+	return slots
 }
 
-func taskToProtobuf(task swarm.Task) *draiosproto.SwarmTask {
-	cidlen := len(task.Status.ContainerStatus.ContainerID)
+// taskContainerInfo is what inspectTaskContainers recovers from a
+// container inspect that the task object doesn't carry itself: the
+// digest-resolved image actually running, and the container's
+// health-check status.
+type taskContainerInfo struct {
+	image  string
+	health string
+}
+
+// maxConcurrentTaskInspects bounds how many ContainerInspect calls
+// inspectTaskContainers has in flight at once, so a cluster with
+// thousands of tasks doesn't turn one resync into thousands of
+// sequential RPCs (nor an unbounded burst of concurrent ones).
+const maxConcurrentTaskInspects = 8
+
+// inspectTaskContainers inspects, with bounded concurrency, every
+// distinct container referenced by tasks. Tasks without a container
+// (not yet started, or non-container tasks), or whose container can no
+// longer be inspected (already removed, etc), are simply absent from
+// the result.
+func inspectTaskContainers(ctx context.Context, cli dockerSwarmClient, tasks []swarm.Task) map[string]taskContainerInfo {
+	ids := make(map[string]struct{})
+	for _, task := range tasks {
+		if task.Status.ContainerStatus != nil && task.Status.ContainerStatus.ContainerID != "" {
+			ids[task.Status.ContainerStatus.ContainerID] = struct{}{}
+		}
+	}
+
+	results := make(map[string]taskContainerInfo, len(ids))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentTaskInspects)
+
+	for id := range ids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(containerID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			info, err := cli.ContainerInspect(ctx, containerID)
+			if err != nil {
+				return
+			}
+			var ci taskContainerInfo
+			ci.image = info.Image
+			if info.State != nil && info.State.Health != nil {
+				ci.health = info.State.Health.Status
+			}
+
+			mu.Lock()
+			results[containerID] = ci
+			mu.Unlock()
+		}(id)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func taskToProtobuf(task swarm.Task, slots map[taskSlot][]swarm.Task, containers map[string]taskContainerInfo) *draiosproto.SwarmTask {
+	// ContainerStatus is nil until a task actually gets a container
+	// (new/pending/assigned/preparing tasks, or ones that never made
+	// it that far), and ContainerSpec is nil for non-container tasks
+	// (e.g. network-attachment tasks). Now that we return tasks in
+	// every lifecycle state rather than just running/accepted ones,
+	// hitting either nil is the common case.
+	var containerID string
+	if task.Status.ContainerStatus != nil {
+		containerID = task.Status.ContainerStatus.ContainerID
+	}
+	cidlen := len(containerID)
 	if cidlen > 12 {
 		cidlen = 12
 	}
-	return &draiosproto.SwarmTask{Common: &draiosproto.SwarmCommon{
+
+	var image, healthStatus string
+	if task.Spec.ContainerSpec != nil {
+		image = task.Spec.ContainerSpec.Image
+	}
+	if ci, ok := containers[containerID]; ok {
+		if ci.image != "" {
+			image = ci.image
+		}
+		healthStatus = ci.health
+	}
+
+	t := &draiosproto.SwarmTask{Common: &draiosproto.SwarmCommon{
 			Id: proto.String(task.ID),
 		},
-		ServiceId:   proto.String(task.ServiceID),
-		NodeId:      proto.String(task.NodeID),
-		ContainerId: proto.String(task.Status.ContainerStatus.ContainerID[:cidlen])}
+		ServiceId:     proto.String(task.ServiceID),
+		NodeId:        proto.String(task.NodeID),
+		ContainerId:   proto.String(containerID[:cidlen]),
+		Slot:          proto.Int32(int32(task.Slot)),
+		DesiredState:  proto.String(string(task.DesiredState)),
+		State:         proto.String(string(task.Status.State)),
+		StatusMessage: proto.String(task.Status.Message),
+		StatusErr:     proto.String(task.Status.Err),
+		Image:         proto.String(image),
+	}
+	if healthStatus != "" {
+		t.HealthStatus = proto.String(healthStatus)
+	}
+
+	key := taskSlot{serviceID: task.ServiceID, slot: task.Slot}
+	if siblings := slots[key]; len(siblings) > 0 {
+		t.RestartCount = proto.Uint32(uint32(len(siblings) - 1))
+		for i, sibling := range siblings {
+			if sibling.ID == task.ID && i+1 < len(siblings) {
+				t.PreviousTaskId = proto.String(siblings[i+1].ID)
+				break
+			}
+		}
+	}
+
+	return t
 }
 
-func nodeToProtobuf(node swarm.Node) *draiosproto.SwarmNode {
-	var addr string
-	// It looks that sometimes node.Status.Addr is 127.0.0.1
-	// on managers, so for them report the ManagerStatus.Addr
-	// docker issue: https://github.com/docker/docker/issues/30119
+// nodeAddr picks the best IP we have for a node. node.Status.Addr is
+// consistently 127.0.0.1 on managers (docker/docker#30119), so prefer
+// ManagerStatus.Addr there; fall back to Status.Addr for workers (or
+// for managers without a reported ManagerStatus.Addr), and finally to
+// the node's hostname when even that is unusable.
+func nodeAddr(node swarm.Node) string {
 	if node.ManagerStatus != nil {
-		addr = strings.Split(node.ManagerStatus.Addr, ":")[0]
-	} else {
-		addr = node.Status.Addr
+		if addr := strings.Split(node.ManagerStatus.Addr, ":")[0]; addr != "" && addr != "127.0.0.1" {
+			return addr
+		}
+	}
+	if addr := node.Status.Addr; addr != "" && addr != "127.0.0.1" {
+		return addr
 	}
+	return node.Description.Hostname
+}
+
+func nodeToProtobuf(node swarm.Node) *draiosproto.SwarmNode {
+	addr := nodeAddr(node)
 	sn := draiosproto.SwarmNode{
 		Common: &draiosproto.SwarmCommon{
 			Id:     proto.String(node.ID),
@@ -91,93 +287,159 @@ func nodeToProtobuf(node swarm.Node) *draiosproto.SwarmNode {
 	return &sn
 }
 
-func quorum(nodes []swarm.Node) (*bool) {
-	var on, total uint32 = 0, 0
+// quorum reports the health of the manager set: how many managers
+// exist versus how many are actually reachable (those aren't the same
+// thing -- a manager can be listed while partitioned or down), whether
+// that's enough for Raft quorum, and whether the elected leader itself
+// is reachable.
+func quorum(nodes []swarm.Node) *draiosproto.SwarmQuorum {
+	var managers, reachable uint32
+	leaderReachable := false
 	for _, node := range nodes {
-		if node.ManagerStatus != nil {
-			if node.ManagerStatus.Reachability == swarm.ReachabilityReachable {
-				on++
-			}
-			total++
+		if node.ManagerStatus == nil {
+			continue
+		}
+		managers++
+		isReachable := node.ManagerStatus.Reachability == swarm.ReachabilityReachable
+		if isReachable {
+			reachable++
+		}
+		if node.ManagerStatus.Leader && isReachable {
+			leaderReachable = true
 		}
 	}
-	var q bool = on >= (total / 2) + 1
-	return &q
+	quorumSize := managers/2 + 1
+
+	return &draiosproto.SwarmQuorum{
+		ManagerCount:      proto.Uint32(managers),
+		ReachableManagers: proto.Uint32(reachable),
+		QuorumSize:        proto.Uint32(quorumSize),
+		HasQuorum:         proto.Bool(reachable >= quorumSize),
+		LeaderReachable:   proto.Bool(leaderReachable),
+	}
 }
 
-func getSwarmState(ctx context.Context, cmd *sdc_internal.SwarmStateCommand) (*sdc_internal.SwarmStateResult, error) {
-	log.Debugf("Received swarmstate command message: %s", cmd.String())
+// dockerSwarmClient is the subset of *client.Client that the swarm
+// collector and watcher need, so the watch loop in swarm_watch.go can
+// be driven without a live docker daemon.
+type dockerSwarmClient interface {
+	Info(ctx context.Context) (types.Info, error)
+	ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error)
+	NodeList(ctx context.Context, options types.NodeListOptions) ([]swarm.Node, error)
+	TaskList(ctx context.Context, options types.TaskListOptions) ([]swarm.Task, error)
+	NetworkList(ctx context.Context, options types.NetworkListOptions) ([]types.NetworkResource, error)
+	SecretList(ctx context.Context, options types.SecretListOptions) ([]swarm.Secret, error)
+	ConfigList(ctx context.Context, options types.ConfigListOptions) ([]swarm.Config, error)
+	ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error)
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+}
 
-	// If SYSDIG_HOST_ROOT is set, use that as a part of the
-	// socket path.
+// collectSwarmState does a one-shot poll of the docker daemon
+// (ServiceList/NodeList/TaskList) and builds the corresponding
+// SwarmState. Both getSwarmState and the WatchSwarmState resync loop
+// use this so there's a single place that knows how to turn docker
+// swarm objects into draiosproto.SwarmState.
+func collectSwarmState(ctx context.Context, cli dockerSwarmClient) (*draiosproto.SwarmState, error) {
+	info, err := cli.Info(ctx)
+	if err != nil {
+		return nil, log.Errorf("Could not get docker client info: %s", err)
+	}
 
-	sysdigRoot := os.Getenv("SYSDIG_HOST_ROOT")
-	if sysdigRoot != "" {
-		sysdigRoot = sysdigRoot + "/"
+	m := &draiosproto.SwarmState{ClusterId: proto.String(info.Swarm.Cluster.ID)}
+	if !info.Swarm.ControlAvailable {
+		return m, nil
 	}
-	dockerSock := fmt.Sprintf("unix:///%svar/run/docker.sock", sysdigRoot)
-	cli, err := client.NewClient(dockerSock, "v1.26", nil, nil)
-	if err != nil {
-		ferr := log.Errorf("Could not create docker client: %s", err)
-		log.Errorf(ferr.Error())
-		return nil, ferr
+
+	if services, err := cli.ServiceList(ctx, types.ServiceListOptions{}); err == nil {
+		for _, service := range services {
+			m.Services = append(m.Services, serviceToProtobuf(service))
+			stack := service.Spec.Labels["com.docker.stack.namespace"]
+			if stack == "" {
+				stack = "none"
+			}
+			// fmt.Printf("service id=%s name=%s stack=%s ip=%s\n", service.ID[:10], service.Spec.Name, stack, virtualIPsToProtobuf(service.Endpoint.VirtualIPs))
+		}
+	} else {
+		log.Errorf("Error fetching services: %s\n", err)
 	}
 
-	info, err := cli.Info(context.Background())
-	if err != nil {
-		ferr := log.Errorf("Could not get docker client info: %s", err)
-		return nil, ferr
+	if nodes, err := cli.NodeList(ctx, types.NodeListOptions{}); err == nil {
+		for _, node := range nodes {
+			m.Nodes = append(m.Nodes, nodeToProtobuf(node))
+			// fmt.Printf("node id=%s name=%s role=%s availability=%s\n", node.ID, node.Description.Hostname, node.Spec.Role, node.Spec.Availability)
+		}
+		m.Quorum = quorum(nodes)
+		if m.Quorum.GetReachableManagers() < m.Quorum.GetQuorumSize() {
+			log.Warnf("Swarm cluster %s is degraded: only %d/%d managers reachable, need %d for quorum",
+				info.Swarm.Cluster.ID, m.Quorum.GetReachableManagers(), m.Quorum.GetManagerCount(), m.Quorum.GetQuorumSize())
+		}
+	} else {
+		log.Errorf("Error fetching nodes: %s\n", err)
 	}
-	clusterId := proto.String(info.Swarm.Cluster.ID)
-	isManager := info.Swarm.ControlAvailable
 
-	m := &draiosproto.SwarmState{ClusterId: clusterId}
+	// No desired-state filter here: we want shutdown/failed/rejected
+	// tasks too, so consumers can see the full lifecycle of a service's
+	// replicas rather than just the ones currently running.
+	if tasks, err := cli.TaskList(ctx, types.TaskListOptions{}); err == nil {
+		slots := taskSlotHistory(tasks)
+		containers := inspectTaskContainers(ctx, cli, tasks)
+		for _, task := range tasks {
+			m.Tasks = append(m.Tasks, taskToProtobuf(task, slots, containers))
+			// fmt.Printf("task id=%s name=%s service=%s node=%s status=%s containerid=%s\n", task.ID, task.Name, task.ServiceID, task.NodeID, task.Status.State, task.Status.ContainerStatus.ContainerID[:12])
+		}
+	} else {
+		log.Errorf("Error fetching tasks: %s\n", err)
+	}
 
-	if isManager {
-		if services, err := cli.ServiceList(ctx, types.ServiceListOptions{}); err == nil {
-			for _, service := range services {
-				m.Services = append(m.Services, serviceToProtobuf(service))
-				stack := service.Spec.Labels["com.docker.stack.namespace"]
-				if stack == "" {
-					stack = "none"
-				}
-				// fmt.Printf("service id=%s name=%s stack=%s ip=%s\n", service.ID[:10], service.Spec.Name, stack, virtualIPsToProtobuf(service.Endpoint.VirtualIPs))
-			}
-		} else {
-			log.Errorf("Error fetching services: %s\n", err)
+	netArgs := filters.NewArgs()
+	netArgs.Add("scope", "swarm")
+	if networks, err := cli.NetworkList(ctx, types.NetworkListOptions{Filters: netArgs}); err == nil {
+		for _, network := range networks {
+			m.Networks = append(m.Networks, networkToProtobuf(network))
 		}
+	} else {
+		log.Errorf("Error fetching networks: %s\n", err)
+	}
 
-		if nodes, err := cli.NodeList(ctx, types.NodeListOptions{}); err == nil {
-			for _, node := range nodes {
-				m.Nodes = append(m.Nodes, nodeToProtobuf(node))
-				// fmt.Printf("node id=%s name=%s role=%s availability=%s\n", node.ID, node.Description.Hostname, node.Spec.Role, node.Spec.Availability)
-			}
-			m.Quorum = quorum(nodes)
-		} else {
-			log.Errorf("Error fetching nodes: %s\n", err)
+	if secrets, err := cli.SecretList(ctx, types.SecretListOptions{}); err == nil {
+		for _, secret := range secrets {
+			m.Secrets = append(m.Secrets, secretToProtobuf(secret))
 		}
+	} else {
+		log.Errorf("Error fetching secrets: %s\n", err)
+	}
 
-		args := filters.NewArgs()
-		args.Add("desired-state", "running")
-		args.Add("desired-state", "accepted")
-		if tasks, err := cli.TaskList(ctx, types.TaskListOptions{Filters: args}); err == nil {
-			for _, task := range tasks {
-				m.Tasks = append(m.Tasks, taskToProtobuf(task))
-				// fmt.Printf("task id=%s name=%s service=%s node=%s status=%s containerid=%s\n", task.ID, task.Name, task.ServiceID, task.NodeID, task.Status.State, task.Status.ContainerStatus.ContainerID[:12])
-			}
-		} else {
-			log.Errorf("Error fetching tasks: %s\n", err)
+	if configs, err := cli.ConfigList(ctx, types.ConfigListOptions{}); err == nil {
+		for _, config := range configs {
+			m.Configs = append(m.Configs, configToProtobuf(config))
 		}
+	} else {
+		log.Errorf("Error fetching configs: %s\n", err)
 	}
 
-    res := &sdc_internal.SwarmStateResult{}
-    res.Successful = proto.Bool(err == nil)
-    if err != nil {
-        res.Errstr = proto.String(err.Error())
-    }
+	return m, nil
+}
+
+func getSwarmState(ctx context.Context, cmd *sdc_internal.SwarmStateCommand) (*sdc_internal.SwarmStateResult, error) {
+	log.Debugf("Received swarmstate command message: %s", cmd.String())
+
+	cli, err := newDockerClientFromCommand(cmd)
+	if err != nil {
+		ferr := log.Errorf("Could not create docker client: %s", err)
+		log.Errorf(ferr.Error())
+		return nil, ferr
+	}
+
+	m, err := collectSwarmState(ctx, cli)
+
+	res := &sdc_internal.SwarmStateResult{}
+	res.Successful = proto.Bool(err == nil)
+	if err != nil {
+		res.Errstr = proto.String(err.Error())
+	}
 	res.State = m
 
-    log.Debugf("SwarmState Sending response: %s", res.String())
+	log.Debugf("SwarmState Sending response: %s", res.String())
 
-    return res, nil
+	return res, nil
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"sdc_internal"
+	log "github.com/cihub/seelog"
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/tlsconfig"
+)
+
+// defaultDockerAPIVersion is used when no API version is configured and
+// negotiation with the daemon leaves the client without a version.
+const defaultDockerAPIVersion = "v1.26"
+
+// dockerClientOptions describes how to reach and authenticate against a
+// docker engine: a unix socket on this host by default, or a remote
+// (possibly mTLS-protected) endpoint.
+type dockerClientOptions struct {
+	Endpoint   string
+	APIVersion string
+	TLSCACert  string
+	TLSCert    string
+	TLSKey     string
+	TLSVerify  bool
+}
+
+// dockerClientOptionsFromEnv fills in any option left unset by the
+// caller from the same environment variables the docker CLI itself
+// honors (DOCKER_HOST, DOCKER_API_VERSION, DOCKER_CERT_PATH,
+// DOCKER_TLS_VERIFY), and falls back to the local unix socket
+// (optionally rooted at SYSDIG_HOST_ROOT) if nothing else applies.
+func dockerClientOptionsFromEnv(opts dockerClientOptions) dockerClientOptions {
+	if opts.Endpoint == "" {
+		opts.Endpoint = os.Getenv("DOCKER_HOST")
+	}
+	if opts.Endpoint == "" {
+		sysdigRoot := os.Getenv("SYSDIG_HOST_ROOT")
+		if sysdigRoot != "" {
+			sysdigRoot = strings.TrimPrefix(sysdigRoot, "/") + "/"
+		}
+		opts.Endpoint = fmt.Sprintf("unix:///%svar/run/docker.sock", sysdigRoot)
+	}
+	if opts.APIVersion == "" {
+		opts.APIVersion = os.Getenv("DOCKER_API_VERSION")
+	}
+	// Deliberately no further default here: client.NewClient treats any
+	// non-empty version as an explicit manual override and skips
+	// negotiation entirely, so leaving this "" when the caller/env
+	// didn't ask for a specific version is what lets
+	// newDockerClientWithOptions actually negotiate against the daemon.
+	certPath := os.Getenv("DOCKER_CERT_PATH")
+	if opts.TLSCACert == "" && certPath != "" {
+		opts.TLSCACert = certPath + "/ca.pem"
+	}
+	if opts.TLSCert == "" && certPath != "" {
+		opts.TLSCert = certPath + "/cert.pem"
+	}
+	if opts.TLSKey == "" && certPath != "" {
+		opts.TLSKey = certPath + "/key.pem"
+	}
+	if !opts.TLSVerify {
+		opts.TLSVerify = os.Getenv("DOCKER_TLS_VERIFY") != ""
+	}
+	return opts
+}
+
+// newDockerClientWithOptions creates and negotiates the API version for
+// a docker client reaching the given endpoint, optionally over TLS.
+func newDockerClientWithOptions(opts dockerClientOptions) (dockerSwarmClient, error) {
+	opts = dockerClientOptionsFromEnv(opts)
+
+	var httpClient *http.Client
+	if opts.TLSCACert != "" || opts.TLSCert != "" || opts.TLSKey != "" || opts.TLSVerify {
+		tlsConf, err := tlsconfig.Client(tlsconfig.Options{
+			CAFile:             opts.TLSCACert,
+			CertFile:           opts.TLSCert,
+			KeyFile:            opts.TLSKey,
+			InsecureSkipVerify: !opts.TLSVerify,
+		})
+		if err != nil {
+			return nil, log.Errorf("Could not build TLS config for docker client: %s", err)
+		}
+		httpClient = &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}}
+	}
+
+	cli, err := client.NewClient(opts.Endpoint, opts.APIVersion, httpClient, nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.APIVersion == "" {
+		// Only negotiate when no version was explicitly requested:
+		// client.NewClient already pins manualOverride when it's given
+		// a non-empty version, which makes NegotiateAPIVersion a no-op,
+		// so calling it unconditionally would give the illusion of
+		// negotiating while actually staying pinned to opts.APIVersion.
+		cli.NegotiateAPIVersion(context.Background())
+		if cli.ClientVersion() == "" {
+			// Negotiation itself talks to the daemon (a Ping) to learn
+			// its version; if that failed too, fall back to the last
+			// version we know this collector worked against.
+			cli.UpdateClientVersion(defaultDockerAPIVersion)
+		}
+	}
+	return cli, nil
+}
+
+// newDockerClientFromCommand builds a docker client honoring the
+// endpoint/API version/TLS settings carried on a SwarmStateCommand.
+func newDockerClientFromCommand(cmd *sdc_internal.SwarmStateCommand) (dockerSwarmClient, error) {
+	return newDockerClientWithOptions(dockerClientOptions{
+		Endpoint:   cmd.GetEndpoint(),
+		APIVersion: cmd.GetApiVersion(),
+		TLSCACert:  cmd.GetTlsCaCert(),
+		TLSCert:    cmd.GetTlsCert(),
+		TLSKey:     cmd.GetTlsKey(),
+		TLSVerify:  cmd.GetTlsVerify(),
+	})
+}
+
+// newDockerClientFromLogsCommand builds a docker client honoring the
+// endpoint/API version/TLS settings carried on a
+// SwarmServiceLogsCommand.
+func newDockerClientFromLogsCommand(cmd *sdc_internal.SwarmServiceLogsCommand) (dockerSwarmClient, error) {
+	return newDockerClientWithOptions(dockerClientOptions{
+		Endpoint:   cmd.GetEndpoint(),
+		APIVersion: cmd.GetApiVersion(),
+		TLSCACert:  cmd.GetTlsCaCert(),
+		TLSCert:    cmd.GetTlsCert(),
+		TLSKey:     cmd.GetTlsKey(),
+		TLSVerify:  cmd.GetTlsVerify(),
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// clearDockerEnv wipes every env var dockerClientOptionsFromEnv reads, so
+// a test isn't at the mercy of whatever docker-related env happens to be
+// set on the machine running it, and restores the previous values after
+// the test completes.
+func clearDockerEnv(t *testing.T) {
+	t.Helper()
+	for _, key := range []string{"DOCKER_HOST", "SYSDIG_HOST_ROOT", "DOCKER_API_VERSION", "DOCKER_CERT_PATH", "DOCKER_TLS_VERIFY"} {
+		key := key
+		old, had := os.LookupEnv(key)
+		os.Unsetenv(key)
+		t.Cleanup(func() {
+			if had {
+				os.Setenv(key, old)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+}
+
+func setEnv(t *testing.T, key, value string) {
+	t.Helper()
+	old, had := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if had {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestDockerClientOptionsFromEnvDefaults(t *testing.T) {
+	clearDockerEnv(t)
+
+	got := dockerClientOptionsFromEnv(dockerClientOptions{})
+	if got.Endpoint != "unix:///var/run/docker.sock" {
+		t.Errorf("Endpoint = %q, want unix:///var/run/docker.sock", got.Endpoint)
+	}
+	if got.APIVersion != "" {
+		t.Errorf("APIVersion = %q, want empty so the caller negotiates", got.APIVersion)
+	}
+	if got.TLSCACert != "" || got.TLSCert != "" || got.TLSKey != "" || got.TLSVerify {
+		t.Errorf("expected no TLS settings by default, got %+v", got)
+	}
+}
+
+func TestDockerClientOptionsFromEnvSysdigHostRoot(t *testing.T) {
+	clearDockerEnv(t)
+	setEnv(t, "SYSDIG_HOST_ROOT", "/host")
+
+	got := dockerClientOptionsFromEnv(dockerClientOptions{})
+	if got.Endpoint != "unix:///host/var/run/docker.sock" {
+		t.Errorf("Endpoint = %q, want unix:///host/var/run/docker.sock", got.Endpoint)
+	}
+}
+
+func TestDockerClientOptionsFromEnvExplicitEndpointWinsOverDockerHost(t *testing.T) {
+	clearDockerEnv(t)
+	setEnv(t, "DOCKER_HOST", "tcp://from-env:2375")
+
+	got := dockerClientOptionsFromEnv(dockerClientOptions{Endpoint: "tcp://explicit:2375"})
+	if got.Endpoint != "tcp://explicit:2375" {
+		t.Errorf("Endpoint = %q, want the explicitly configured endpoint to win", got.Endpoint)
+	}
+}
+
+func TestDockerClientOptionsFromEnvDockerHostFallback(t *testing.T) {
+	clearDockerEnv(t)
+	setEnv(t, "DOCKER_HOST", "tcp://from-env:2375")
+
+	got := dockerClientOptionsFromEnv(dockerClientOptions{})
+	if got.Endpoint != "tcp://from-env:2375" {
+		t.Errorf("Endpoint = %q, want DOCKER_HOST value", got.Endpoint)
+	}
+}
+
+func TestDockerClientOptionsFromEnvAPIVersionPrecedence(t *testing.T) {
+	clearDockerEnv(t)
+	setEnv(t, "DOCKER_API_VERSION", "v1.30")
+
+	got := dockerClientOptionsFromEnv(dockerClientOptions{})
+	if got.APIVersion != "v1.30" {
+		t.Errorf("APIVersion = %q, want DOCKER_API_VERSION value", got.APIVersion)
+	}
+
+	got = dockerClientOptionsFromEnv(dockerClientOptions{APIVersion: "v1.40"})
+	if got.APIVersion != "v1.40" {
+		t.Errorf("APIVersion = %q, want the explicitly configured version to win over DOCKER_API_VERSION", got.APIVersion)
+	}
+}
+
+func TestDockerClientOptionsFromEnvTLSCertPath(t *testing.T) {
+	clearDockerEnv(t)
+	setEnv(t, "DOCKER_CERT_PATH", "/certs")
+
+	got := dockerClientOptionsFromEnv(dockerClientOptions{})
+	if got.TLSCACert != "/certs/ca.pem" {
+		t.Errorf("TLSCACert = %q, want /certs/ca.pem", got.TLSCACert)
+	}
+	if got.TLSCert != "/certs/cert.pem" {
+		t.Errorf("TLSCert = %q, want /certs/cert.pem", got.TLSCert)
+	}
+	if got.TLSKey != "/certs/key.pem" {
+		t.Errorf("TLSKey = %q, want /certs/key.pem", got.TLSKey)
+	}
+
+	// Explicitly configured TLS paths must not be clobbered by the
+	// DOCKER_CERT_PATH-derived defaults.
+	got = dockerClientOptionsFromEnv(dockerClientOptions{TLSCACert: "/explicit/ca.pem"})
+	if got.TLSCACert != "/explicit/ca.pem" {
+		t.Errorf("TLSCACert = %q, want the explicitly configured path to win", got.TLSCACert)
+	}
+}
+
+func TestDockerClientOptionsFromEnvTLSVerify(t *testing.T) {
+	clearDockerEnv(t)
+	setEnv(t, "DOCKER_TLS_VERIFY", "1")
+
+	got := dockerClientOptionsFromEnv(dockerClientOptions{})
+	if !got.TLSVerify {
+		t.Errorf("TLSVerify = false, want true when DOCKER_TLS_VERIFY is set")
+	}
+
+	clearDockerEnv(t)
+	got = dockerClientOptionsFromEnv(dockerClientOptions{})
+	if got.TLSVerify {
+		t.Errorf("TLSVerify = true, want false when DOCKER_TLS_VERIFY is unset")
+	}
+}
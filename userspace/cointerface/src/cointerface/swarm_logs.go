@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"draiosproto"
+	"sdc_internal"
+	log "github.com/cihub/seelog"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/gogo/protobuf/proto"
+)
+
+// dockerSwarmLogsClient is the subset of *client.Client needed to tail
+// logs for every task of a service, or for a single named task.
+type dockerSwarmLogsClient interface {
+	dockerSwarmClient
+	ServiceLogs(ctx context.Context, serviceID string, options types.ContainerLogsOptions) (io.ReadCloser, error)
+	ContainerLogs(ctx context.Context, container string, options types.ContainerLogsOptions) (io.ReadCloser, error)
+}
+
+// swarmServiceLogsStream is the subset of the generated
+// SDCInternal_SwarmServiceLogsServer interface that
+// swarmServiceLogs relies on.
+type swarmServiceLogsStream interface {
+	Send(*sdc_internal.SwarmServiceLogsResult) error
+	Context() context.Context
+}
+
+// swarmServiceLogs implements the SwarmServiceLogsCommand handler: it
+// tails the named service's log stream (which docker already
+// multiplexes across every task/replica of the service) and forwards
+// each line to the agent, optionally throttled to a maximum number of
+// bytes per second so a noisy service can't flood the grpc channel.
+func swarmServiceLogs(cmd *sdc_internal.SwarmServiceLogsCommand, stream swarmServiceLogsStream) error {
+	ctx := stream.Context()
+	log.Debugf("Received swarm service logs command message: %s", cmd.String())
+
+	cli, err := newDockerClientFromLogsCommand(cmd)
+	if err != nil {
+		return log.Errorf("Could not create docker client: %s", err)
+	}
+	logsCli, ok := cli.(dockerSwarmLogsClient)
+	if !ok {
+		return log.Errorf("docker client does not support ServiceLogs")
+	}
+
+	options := types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     cmd.GetFollow(),
+		Since:      cmd.GetSinceTimestamp(),
+		Tail:       cmd.GetTail(),
+	}
+
+	var rc io.ReadCloser
+	if taskID := cmd.GetTaskId(); taskID != "" {
+		rc, err = taskContainerLogs(ctx, logsCli, taskID, options)
+		if err != nil {
+			return log.Errorf("Could not tail logs for task %s: %s", taskID, err)
+		}
+	} else {
+		rc, err = logsCli.ServiceLogs(ctx, cmd.GetServiceName(), options)
+		if err != nil {
+			return log.Errorf("Could not tail logs for service %s: %s", cmd.GetServiceName(), err)
+		}
+	}
+	defer rc.Close()
+
+	limiter := newByteRateLimiter(cmd.GetMaxBytesPerSec())
+
+	stdout := newSwarmServiceLogsWriter(draiosproto.SwarmServiceLogsStream_STDOUT, stream, limiter)
+	stderr := newSwarmServiceLogsWriter(draiosproto.SwarmServiceLogsStream_STDERR, stream, limiter)
+	_, err = stdcopy.StdCopy(stdout, stderr, rc)
+	if err != nil && err != io.EOF {
+		return log.Errorf("Error streaming logs for service %s: %s", cmd.GetServiceName(), err)
+	}
+	return nil
+}
+
+// taskContainerLogs resolves a task ID to the container currently
+// backing it and tails that container's logs directly, for callers that
+// want a single replica's output rather than the whole service's
+// interleaved stream. Like ServiceLogs, the container's log frames are
+// still stdcopy-multiplexed, so swarmServiceLogs can demux both the same
+// way regardless of which path produced rc.
+func taskContainerLogs(ctx context.Context, cli dockerSwarmLogsClient, taskID string, options types.ContainerLogsOptions) (io.ReadCloser, error) {
+	args := filters.NewArgs()
+	args.Add("id", taskID)
+	tasks, err := cli.TaskList(ctx, types.TaskListOptions{Filters: args})
+	if err != nil {
+		return nil, err
+	}
+	if len(tasks) == 0 || tasks[0].Status.ContainerStatus == nil || tasks[0].Status.ContainerStatus.ContainerID == "" {
+		return nil, fmt.Errorf("task %s has no container to tail logs from", taskID)
+	}
+	return cli.ContainerLogs(ctx, tasks[0].Status.ContainerStatus.ContainerID, options)
+}
+
+// swarmServiceLogsWriter adapts the demultiplexed stdout/stderr streams
+// from stdcopy.StdCopy into per-line SwarmServiceLogsResult messages.
+// Docker's swarm log frames are prefixed with the originating
+// node/task/container identity (e.g. "task_name.1.abcdef@node1  | ..."),
+// which we pass through as-is so the agent can attribute each line.
+// stdcopy.StdCopy calls Write synchronously, one frame at a time, so no
+// locking is needed here.
+type swarmServiceLogsWriter struct {
+	kind    draiosproto.SwarmServiceLogsStream
+	stream  swarmServiceLogsStream
+	limiter *byteRateLimiter
+	pending []byte
+}
+
+func newSwarmServiceLogsWriter(kind draiosproto.SwarmServiceLogsStream, stream swarmServiceLogsStream, limiter *byteRateLimiter) *swarmServiceLogsWriter {
+	return &swarmServiceLogsWriter{kind: kind, stream: stream, limiter: limiter}
+}
+
+func (w *swarmServiceLogsWriter) Write(p []byte) (int, error) {
+	w.pending = append(w.pending, p...)
+	for {
+		i := bytes.IndexByte(w.pending, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(w.pending[:i])
+		w.pending = w.pending[i+1:]
+		w.limiter.wait(len(line))
+		if err := w.stream.Send(&sdc_internal.SwarmServiceLogsResult{
+			Stream: w.kind.Enum(),
+			Line:   proto.String(line),
+		}); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// byteRateLimiter caps throughput to a configured bytes/sec budget; a
+// limit of 0 disables throttling entirely.
+type byteRateLimiter struct {
+	limit    uint32
+	used     uint32
+	periodAt time.Time
+}
+
+func newByteRateLimiter(limitBytesPerSec uint32) *byteRateLimiter {
+	return &byteRateLimiter{limit: limitBytesPerSec, periodAt: time.Now()}
+}
+
+func (l *byteRateLimiter) wait(n int) {
+	if l.limit == 0 {
+		return
+	}
+	if time.Since(l.periodAt) >= time.Second {
+		l.periodAt = time.Now()
+		l.used = 0
+	}
+	l.used += uint32(n)
+	if l.used > l.limit {
+		time.Sleep(time.Second - time.Since(l.periodAt))
+		l.periodAt = time.Now()
+		l.used = 0
+	}
+}
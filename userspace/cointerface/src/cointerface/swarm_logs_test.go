@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestByteRateLimiterNoLimitDoesNotBlock(t *testing.T) {
+	l := newByteRateLimiter(0)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		l.wait(1 << 20)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("wait() blocked for %s with limiting disabled", elapsed)
+	}
+}
+
+func TestByteRateLimiterUnderBudgetDoesNotBlock(t *testing.T) {
+	l := newByteRateLimiter(1000)
+	start := time.Now()
+	l.wait(100)
+	l.wait(100)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("wait() blocked for %s while under the per-second budget", elapsed)
+	}
+}
+
+func TestByteRateLimiterOverBudgetBlocksUntilNextPeriod(t *testing.T) {
+	l := newByteRateLimiter(10)
+	l.wait(5)
+
+	start := time.Now()
+	l.wait(10) // 15 bytes used this period, over the 10 byte/sec budget
+	elapsed := time.Since(start)
+
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("wait() returned after %s, expected it to block close to a second", elapsed)
+	}
+	if elapsed > 1500*time.Millisecond {
+		t.Errorf("wait() blocked for %s, expected roughly a second", elapsed)
+	}
+}
+
+func TestByteRateLimiterResetsAfterPeriod(t *testing.T) {
+	l := newByteRateLimiter(10)
+	l.periodAt = time.Now().Add(-2 * time.Second)
+	l.used = 10
+
+	start := time.Now()
+	l.wait(5) // previous period is stale, so this should not block
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("wait() blocked for %s after the budget period had already elapsed", elapsed)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"testing"
+
+	"draiosproto"
+	"github.com/docker/docker/api/types/swarm"
+)
+
+func TestNodeAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		node swarm.Node
+		want string
+	}{
+		{
+			name: "worker uses Status.Addr",
+			node: swarm.Node{
+				Status:      swarm.NodeStatus{Addr: "10.0.0.5"},
+				Description: swarm.NodeDescription{Hostname: "worker1"},
+			},
+			want: "10.0.0.5",
+		},
+		{
+			name: "manager with sane ManagerStatus.Addr",
+			node: swarm.Node{
+				Status:        swarm.NodeStatus{Addr: "10.0.0.2"},
+				ManagerStatus: &swarm.ManagerStatus{Addr: "10.0.0.2:2377"},
+				Description:   swarm.NodeDescription{Hostname: "manager1"},
+			},
+			want: "10.0.0.2",
+		},
+		{
+			name: "manager with 127.0.0.1 Status.Addr falls back to ManagerStatus.Addr",
+			node: swarm.Node{
+				Status:        swarm.NodeStatus{Addr: "127.0.0.1"},
+				ManagerStatus: &swarm.ManagerStatus{Addr: "10.0.0.3:2377"},
+				Description:   swarm.NodeDescription{Hostname: "manager2"},
+			},
+			want: "10.0.0.3",
+		},
+		{
+			name: "manager with 127.0.0.1 everywhere falls back to hostname",
+			node: swarm.Node{
+				Status:        swarm.NodeStatus{Addr: "127.0.0.1"},
+				ManagerStatus: &swarm.ManagerStatus{Addr: "127.0.0.1:2377"},
+				Description:   swarm.NodeDescription{Hostname: "manager3"},
+			},
+			want: "manager3",
+		},
+		{
+			name: "no addr at all falls back to hostname",
+			node: swarm.Node{
+				Description: swarm.NodeDescription{Hostname: "worker2"},
+			},
+			want: "worker2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nodeAddr(tt.node); got != tt.want {
+				t.Errorf("nodeAddr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func reachableManager(leader bool) swarm.Node {
+	return swarm.Node{ManagerStatus: &swarm.ManagerStatus{Leader: leader, Reachability: swarm.ReachabilityReachable}}
+}
+
+func unreachableManager(leader bool) swarm.Node {
+	return swarm.Node{ManagerStatus: &swarm.ManagerStatus{Leader: leader, Reachability: swarm.ReachabilityUnreachable}}
+}
+
+func worker() swarm.Node {
+	return swarm.Node{}
+}
+
+func TestQuorum(t *testing.T) {
+	tests := []struct {
+		name                  string
+		nodes                 []swarm.Node
+		wantManagerCount      uint32
+		wantReachableManagers uint32
+		wantQuorumSize        uint32
+		wantHasQuorum         bool
+		wantLeaderReachable   bool
+	}{
+		{
+			name:                  "3 managers all reachable, odd-sized quorum",
+			nodes:                 []swarm.Node{reachableManager(true), reachableManager(false), reachableManager(false), worker()},
+			wantManagerCount:      3,
+			wantReachableManagers: 3,
+			wantQuorumSize:        2,
+			wantHasQuorum:         true,
+			wantLeaderReachable:   true,
+		},
+		{
+			name:                  "4 managers (even-sized), 2 reachable is not quorum",
+			nodes:                 []swarm.Node{reachableManager(true), reachableManager(false), unreachableManager(false), unreachableManager(false)},
+			wantManagerCount:      4,
+			wantReachableManagers: 2,
+			wantQuorumSize:        3,
+			wantHasQuorum:         false,
+			wantLeaderReachable:   true,
+		},
+		{
+			name:                  "leader unreachable but quorum otherwise intact",
+			nodes:                 []swarm.Node{unreachableManager(true), reachableManager(false), reachableManager(false)},
+			wantManagerCount:      3,
+			wantReachableManagers: 2,
+			wantQuorumSize:        2,
+			wantHasQuorum:         true,
+			wantLeaderReachable:   false,
+		},
+		{
+			name:                  "no managers reported at all",
+			nodes:                 []swarm.Node{worker(), worker()},
+			wantManagerCount:      0,
+			wantReachableManagers: 0,
+			wantQuorumSize:        1,
+			wantHasQuorum:         false,
+			wantLeaderReachable:   false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := quorum(tt.nodes)
+			if got := q.GetManagerCount(); got != tt.wantManagerCount {
+				t.Errorf("ManagerCount = %d, want %d", got, tt.wantManagerCount)
+			}
+			if got := q.GetReachableManagers(); got != tt.wantReachableManagers {
+				t.Errorf("ReachableManagers = %d, want %d", got, tt.wantReachableManagers)
+			}
+			if got := q.GetQuorumSize(); got != tt.wantQuorumSize {
+				t.Errorf("QuorumSize = %d, want %d", got, tt.wantQuorumSize)
+			}
+			if got := q.GetHasQuorum(); got != tt.wantHasQuorum {
+				t.Errorf("HasQuorum = %v, want %v", got, tt.wantHasQuorum)
+			}
+			if got := q.GetLeaderReachable(); got != tt.wantLeaderReachable {
+				t.Errorf("LeaderReachable = %v, want %v", got, tt.wantLeaderReachable)
+			}
+		})
+	}
+}
+
+func slotTask(id, serviceID string, slot int, version uint64) swarm.Task {
+	return swarm.Task{
+		ID:        id,
+		ServiceID: serviceID,
+		Slot:      slot,
+		Meta:      swarm.Meta{Version: swarm.Version{Index: version}},
+	}
+}
+
+func TestTaskSlotHistory(t *testing.T) {
+	tasks := []swarm.Task{
+		slotTask("task-v1", "svc1", 1, 10),
+		slotTask("task-v2", "svc1", 1, 20),
+		slotTask("task-v3", "svc1", 1, 30),
+		slotTask("other-slot", "svc1", 2, 5),
+		slotTask("other-service", "svc2", 1, 40),
+	}
+
+	slots := taskSlotHistory(tasks)
+
+	svc1Slot1 := slots[taskSlot{serviceID: "svc1", slot: 1}]
+	if len(svc1Slot1) != 3 {
+		t.Fatalf("expected 3 tasks in svc1/slot1, got %d", len(svc1Slot1))
+	}
+	if svc1Slot1[0].ID != "task-v3" || svc1Slot1[1].ID != "task-v2" || svc1Slot1[2].ID != "task-v1" {
+		t.Fatalf("expected newest-first ordering by version, got %v", []string{svc1Slot1[0].ID, svc1Slot1[1].ID, svc1Slot1[2].ID})
+	}
+
+	t3 := taskToProtobuf(svc1Slot1[0], slots, nil)
+	if t3.GetRestartCount() != 2 {
+		t.Errorf("task-v3 RestartCount = %d, want 2", t3.GetRestartCount())
+	}
+	if t3.GetPreviousTaskId() != "task-v2" {
+		t.Errorf("task-v3 PreviousTaskId = %q, want task-v2", t3.GetPreviousTaskId())
+	}
+
+	t1 := taskToProtobuf(svc1Slot1[2], slots, nil)
+	if t1.GetRestartCount() != 2 {
+		t.Errorf("task-v1 RestartCount = %d, want 2", t1.GetRestartCount())
+	}
+	if t1.GetPreviousTaskId() != "" {
+		t.Errorf("task-v1 (oldest in slot) PreviousTaskId = %q, want empty", t1.GetPreviousTaskId())
+	}
+}
+
+func TestTaskToProtobufNilContainerFields(t *testing.T) {
+	// A freshly assigned task has no ContainerStatus/ContainerSpec yet;
+	// taskToProtobuf must not panic on it.
+	task := swarm.Task{ID: "new-task", ServiceID: "svc1", Slot: 1}
+	slots := taskSlotHistory([]swarm.Task{task})
+
+	got := taskToProtobuf(task, slots, nil)
+	if got.GetContainerId() != "" {
+		t.Errorf("ContainerId = %q, want empty", got.GetContainerId())
+	}
+	if got.GetImage() != "" {
+		t.Errorf("Image = %q, want empty", got.GetImage())
+	}
+}
+
+func TestSwarmStateCacheApplyFullStateDiffing(t *testing.T) {
+	cache := newSwarmStateCache()
+
+	svc1 := serviceToProtobuf(swarm.Service{ID: "svc1"})
+	svc2 := serviceToProtobuf(swarm.Service{ID: "svc2"})
+
+	delta := cache.applyFullState(&draiosproto.SwarmState{Services: []*draiosproto.SwarmService{svc1, svc2}})
+	if len(delta.Services) != 2 {
+		t.Fatalf("first resync: expected 2 added services, got %d", len(delta.Services))
+	}
+	if len(delta.RemovedServices) != 0 {
+		t.Fatalf("first resync: expected 0 removed services, got %d", len(delta.RemovedServices))
+	}
+
+	// Second resync: svc1 unchanged, svc2 removed, svc3 added.
+	svc3 := serviceToProtobuf(swarm.Service{ID: "svc3"})
+	delta = cache.applyFullState(&draiosproto.SwarmState{Services: []*draiosproto.SwarmService{svc1, svc3}})
+
+	if len(delta.Services) != 1 || delta.Services[0].Common.GetId() != "svc3" {
+		t.Fatalf("second resync: expected only svc3 added, got %v", delta.Services)
+	}
+	if len(delta.RemovedServices) != 1 || delta.RemovedServices[0] != "svc2" {
+		t.Fatalf("second resync: expected svc2 removed, got %v", delta.RemovedServices)
+	}
+}
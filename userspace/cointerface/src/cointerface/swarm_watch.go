@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"time"
+
+	"draiosproto"
+	"sdc_internal"
+	log "github.com/cihub/seelog"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/gogo/protobuf/proto"
+)
+
+// errEventsStreamClosed is returned from watchSwarmStateOnce when the
+// docker events stream's error channel closes without ever sending an
+// error, so the caller still treats it as a disconnect worth backing
+// off for instead of a clean, reconnect-immediately success.
+var errEventsStreamClosed = errors.New("docker events stream closed")
+
+// How often we throw away the event-derived cache and rebuild it from
+// scratch via ServiceList/NodeList/TaskList, in case we missed or
+// misinterpreted an event (manager failover, leader change, dropped
+// connection, ...).
+const swarmWatchResyncInterval = 30 * time.Second
+
+// Backoff applied between attempts to (re)open the docker events stream,
+// e.g. while a manager election is in progress.
+const swarmWatchMinReconnectDelay = 1 * time.Second
+const swarmWatchMaxReconnectDelay = 30 * time.Second
+
+// swarmWatchEventDebounce bounds how many resyncs a burst of docker
+// events can trigger: once the first event of a burst is seen, we wait
+// this long before resyncing so the rest of the burst (e.g. every task
+// of a rolling update transitioning in turn) collapses into that one
+// resync instead of one each.
+const swarmWatchEventDebounce = 1 * time.Second
+
+// swarmStateStream is the subset of the generated
+// SDCInternal_WatchSwarmStateServer interface that watchSwarmState
+// relies on.
+type swarmStateStream interface {
+	Send(*sdc_internal.SwarmStateResult) error
+	Context() context.Context
+}
+
+// swarmStateCache remembers the last protobuf representation sent for
+// each service/node/task so that watchSwarmState only has to ship
+// deltas down the stream instead of the whole cluster state every time.
+type swarmStateCache struct {
+	services map[string]*draiosproto.SwarmService
+	nodes    map[string]*draiosproto.SwarmNode
+	tasks    map[string]*draiosproto.SwarmTask
+	networks map[string]*draiosproto.SwarmNetwork
+	secrets  map[string]*draiosproto.SwarmSecret
+	configs  map[string]*draiosproto.SwarmConfig
+}
+
+func newSwarmStateCache() *swarmStateCache {
+	return &swarmStateCache{
+		services: make(map[string]*draiosproto.SwarmService),
+		nodes:    make(map[string]*draiosproto.SwarmNode),
+		tasks:    make(map[string]*draiosproto.SwarmTask),
+		networks: make(map[string]*draiosproto.SwarmNetwork),
+		secrets:  make(map[string]*draiosproto.SwarmSecret),
+		configs:  make(map[string]*draiosproto.SwarmConfig),
+	}
+}
+
+// applyFullState replaces the cache with a freshly collected SwarmState,
+// returning the add/update/remove results needed to bring a consumer
+// that only saw the previous cache up to date.
+func (c *swarmStateCache) applyFullState(m *draiosproto.SwarmState) *draiosproto.SwarmState {
+	delta := &draiosproto.SwarmState{ClusterId: m.ClusterId}
+
+	services := make(map[string]*draiosproto.SwarmService, len(m.Services))
+	for _, svc := range m.Services {
+		services[svc.Common.GetId()] = svc
+		if old, ok := c.services[svc.Common.GetId()]; !ok || !reflect.DeepEqual(old, svc) {
+			delta.Services = append(delta.Services, svc)
+		}
+	}
+	for id, old := range c.services {
+		if _, ok := services[id]; !ok {
+			delta.RemovedServices = append(delta.RemovedServices, old.Common.GetId())
+		}
+	}
+	c.services = services
+
+	nodes := make(map[string]*draiosproto.SwarmNode, len(m.Nodes))
+	for _, node := range m.Nodes {
+		nodes[node.Common.GetId()] = node
+		if old, ok := c.nodes[node.Common.GetId()]; !ok || !reflect.DeepEqual(old, node) {
+			delta.Nodes = append(delta.Nodes, node)
+		}
+	}
+	for id, old := range c.nodes {
+		if _, ok := nodes[id]; !ok {
+			delta.RemovedNodes = append(delta.RemovedNodes, old.Common.GetId())
+		}
+	}
+	c.nodes = nodes
+
+	tasks := make(map[string]*draiosproto.SwarmTask, len(m.Tasks))
+	for _, task := range m.Tasks {
+		tasks[task.Common.GetId()] = task
+		if old, ok := c.tasks[task.Common.GetId()]; !ok || !reflect.DeepEqual(old, task) {
+			delta.Tasks = append(delta.Tasks, task)
+		}
+	}
+	for id, old := range c.tasks {
+		if _, ok := tasks[id]; !ok {
+			delta.RemovedTasks = append(delta.RemovedTasks, old.Common.GetId())
+		}
+	}
+	c.tasks = tasks
+
+	networks := make(map[string]*draiosproto.SwarmNetwork, len(m.Networks))
+	for _, network := range m.Networks {
+		networks[network.Common.GetId()] = network
+		if old, ok := c.networks[network.Common.GetId()]; !ok || !reflect.DeepEqual(old, network) {
+			delta.Networks = append(delta.Networks, network)
+		}
+	}
+	for id, old := range c.networks {
+		if _, ok := networks[id]; !ok {
+			delta.RemovedNetworks = append(delta.RemovedNetworks, old.Common.GetId())
+		}
+	}
+	c.networks = networks
+
+	secrets := make(map[string]*draiosproto.SwarmSecret, len(m.Secrets))
+	for _, secret := range m.Secrets {
+		secrets[secret.Common.GetId()] = secret
+		if old, ok := c.secrets[secret.Common.GetId()]; !ok || !reflect.DeepEqual(old, secret) {
+			delta.Secrets = append(delta.Secrets, secret)
+		}
+	}
+	for id, old := range c.secrets {
+		if _, ok := secrets[id]; !ok {
+			delta.RemovedSecrets = append(delta.RemovedSecrets, old.Common.GetId())
+		}
+	}
+	c.secrets = secrets
+
+	configs := make(map[string]*draiosproto.SwarmConfig, len(m.Configs))
+	for _, config := range m.Configs {
+		configs[config.Common.GetId()] = config
+		if old, ok := c.configs[config.Common.GetId()]; !ok || !reflect.DeepEqual(old, config) {
+			delta.Configs = append(delta.Configs, config)
+		}
+	}
+	for id, old := range c.configs {
+		if _, ok := configs[id]; !ok {
+			delta.RemovedConfigs = append(delta.RemovedConfigs, old.Common.GetId())
+		}
+	}
+	c.configs = configs
+
+	delta.Quorum = m.Quorum
+	return delta
+}
+
+// swarmStateDeltaEmpty reports whether a delta has nothing worth sending.
+func swarmStateDeltaEmpty(delta *draiosproto.SwarmState) bool {
+	return len(delta.Services) == 0 && len(delta.RemovedServices) == 0 &&
+		len(delta.Nodes) == 0 && len(delta.RemovedNodes) == 0 &&
+		len(delta.Tasks) == 0 && len(delta.RemovedTasks) == 0 &&
+		len(delta.Networks) == 0 && len(delta.RemovedNetworks) == 0 &&
+		len(delta.Secrets) == 0 && len(delta.RemovedSecrets) == 0 &&
+		len(delta.Configs) == 0 && len(delta.RemovedConfigs) == 0
+}
+
+// watchSwarmState is the handler behind the WatchSwarmState gRPC method.
+// Instead of polling ServiceList/NodeList/TaskList on every call like
+// getSwarmState does, it opens a docker events stream filtered to the
+// swarm object kinds we care about and pushes incremental updates as
+// they happen, periodically doing a full resync to self-heal from any
+// missed or misinterpreted event.
+func watchSwarmState(cmd *sdc_internal.SwarmStateCommand, stream swarmStateStream) error {
+	ctx := stream.Context()
+	log.Debugf("Received watch swarmstate command message: %s", cmd.String())
+
+	cache := newSwarmStateCache()
+	reconnectDelay := swarmWatchMinReconnectDelay
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		cli, err := newDockerClientFromCommand(cmd)
+		if err != nil {
+			log.Errorf("Could not create docker client: %s", err)
+			return err
+		}
+
+		if err := watchSwarmStateOnce(ctx, cli, cache, stream); err != nil {
+			log.Warnf("swarm watch loop interrupted, reconnecting in %s: %s", reconnectDelay, err)
+			select {
+			case <-time.After(reconnectDelay):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if reconnectDelay < swarmWatchMaxReconnectDelay {
+				reconnectDelay *= 2
+				if reconnectDelay > swarmWatchMaxReconnectDelay {
+					reconnectDelay = swarmWatchMaxReconnectDelay
+				}
+			}
+			continue
+		}
+		reconnectDelay = swarmWatchMinReconnectDelay
+	}
+}
+
+// watchSwarmStateOnce sends an initial full snapshot, then follows the
+// docker events stream (with a periodic forced resync) until the
+// connection is lost, the manager stops being a manager (failover), or
+// the context is cancelled.
+func watchSwarmStateOnce(ctx context.Context, cli dockerSwarmClient, cache *swarmStateCache, stream swarmStateStream) error {
+	resync := func() error {
+		info, err := cli.Info(ctx)
+		if err != nil {
+			return err
+		}
+		if !info.Swarm.ControlAvailable {
+			return errors.New("docker node is not a swarm manager")
+		}
+		m, err := collectSwarmState(ctx, cli)
+		if err != nil {
+			return err
+		}
+		delta := cache.applyFullState(m)
+		if swarmStateDeltaEmpty(delta) {
+			return nil
+		}
+		return stream.Send(&sdc_internal.SwarmStateResult{
+			Successful: proto.Bool(true),
+			State:      delta,
+		})
+	}
+
+	if err := resync(); err != nil {
+		return err
+	}
+
+	args := filters.NewArgs()
+	args.Add("type", "service")
+	args.Add("type", "node")
+	args.Add("type", "task")
+	events, errs := cli.Events(ctx, types.EventsOptions{Filters: args})
+
+	ticker := time.NewTicker(swarmWatchResyncInterval)
+	defer ticker.Stop()
+
+	// A rolling update touching hundreds of replicas fires one docker
+	// event per task transition, and the event payload only tells us
+	// *that* something changed, not the resulting object, so each one
+	// would otherwise trigger its own full resync -- turning this loop
+	// into exactly the O(events x N) polling storm chunk0-1 was written
+	// to avoid. Instead, the first event of a burst arms a one-shot
+	// debounce timer and every event that arrives before it fires is
+	// absorbed for free; the timer firing is what actually resyncs, so a
+	// burst of any size still costs a single resync.
+	var debounce *time.Timer
+	var debounceC <-chan time.Time
+	defer func() {
+		if debounce != nil {
+			debounce.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err, ok := <-errs:
+			if !ok {
+				// The docker client closed the error channel without
+				// sending anything -- a normal way for the events
+				// stream to end, but still a disconnect from our
+				// point of view. Treat it like any other error so the
+				// caller backs off instead of reconnecting in a tight
+				// loop.
+				return errEventsStreamClosed
+			}
+			return err
+		case <-ticker.C:
+			if err := resync(); err != nil {
+				return err
+			}
+		case <-events:
+			if debounce == nil {
+				debounce = time.NewTimer(swarmWatchEventDebounce)
+				debounceC = debounce.C
+			}
+		case <-debounceC:
+			debounce = nil
+			debounceC = nil
+			if err := resync(); err != nil {
+				return err
+			}
+		}
+	}
+}